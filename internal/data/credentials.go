@@ -0,0 +1,196 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	CredentialKindSSHKey     = "ssh_key"
+	CredentialKindClientCert = "client_cert"
+)
+
+var ErrDuplicateCredential = errors.New("duplicate credential")
+
+// Credential is a non-password authenticator bound to a user: an SSH
+// public key or an X.509 client certificate. The private material never
+// touches the database; for SSH keys the public key itself is stored too
+// (not just its fingerprint), since VerifySSHChallenge needs it to check a
+// signature, while for certificates the fingerprint alone is sufficient
+// because the whole cert chain is re-presented by the TLS handshake on
+// every request.
+type Credential struct {
+	ID          int64      `json:"id"`
+	UUID        string     `json:"-"`
+	Kind        string     `json:"kind"`
+	Fingerprint string     `json:"fingerprint"`
+	PublicKey   []byte     `json:"-"`
+	Label       string     `json:"label"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	Revoked     bool       `json:"revoked"`
+}
+
+// certFingerprint hashes the DER-encoded SubjectPublicKeyInfo of a client
+// certificate, not the whole certificate, so re-issuing a cert with the
+// same key (e.g. on renewal) doesn't invalidate existing credentials.
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "SHA256:" + base64.StdEncoding.WithPadding(base64.NoPadding).EncodeToString(sum[:])
+}
+
+type CredentialModel struct {
+	DB *sql.DB
+}
+
+// AddSSHKey parses authorizedKeyLine (a single "ssh-ed25519 AAAA... [comment]"
+// style line, as found in an authorized_keys file) and registers it as a
+// login credential for the given user. The parsed public key is stored
+// alongside its SHA-256 fingerprint so a later SSH-agent login can verify a
+// signature against it.
+func (m CredentialModel) AddSSHKey(userUUID string, authorizedKeyLine []byte, label string, expiry *time.Time) (*Credential, error) {
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey(authorizedKeyLine)
+	if err != nil {
+		return nil, fmt.Errorf("data: parsing SSH public key: %w", err)
+	}
+	return m.insert(userUUID, CredentialKindSSHKey, ssh.FingerprintSHA256(pubKey), pubKey.Marshal(), label, expiry)
+}
+
+// AddClientCert parses certPEM and registers the certificate's public key
+// as a login credential for the given user.
+func (m CredentialModel) AddClientCert(userUUID string, certPEM []byte, label string, expiry *time.Time) (*Credential, error) {
+	cert, err := parseClientCertPEM(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	return m.insert(userUUID, CredentialKindClientCert, certFingerprint(cert), nil, label, expiry)
+}
+
+func (m CredentialModel) insert(userUUID, kind, fingerprint string, publicKey []byte, label string, expiry *time.Time) (*Credential, error) {
+	credential := &Credential{
+		UUID:        userUUID,
+		Kind:        kind,
+		Fingerprint: fingerprint,
+		PublicKey:   publicKey,
+		Label:       label,
+		ExpiresAt:   expiry,
+	}
+
+	query := `
+	INSERT INTO credentials (uuid, kind, fingerprint, public_key, label, expires_at)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	RETURNING id, created_at`
+	args := []interface{}{userUUID, kind, fingerprint, publicKey, label, expiry}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&credential.ID, &credential.CreatedAt)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "credentials_fingerprint_key"`:
+			return nil, ErrDuplicateCredential
+		default:
+			return nil, err
+		}
+	}
+	return credential, nil
+}
+
+// GetUserByKeyFingerprint looks up the user owning an active (non-revoked,
+// non-expired) credential with the given fingerprint. fp must already be in
+// the "SHA256:<base64>" form produced by ssh.FingerprintSHA256/certFingerprint.
+func (m CredentialModel) GetUserByKeyFingerprint(fp string) (*User, error) {
+	query := `
+	SELECT users.uuid, users.created_at, users.username, users.email, users.password_hash, users.activated, users.mfa_enabled, users.version
+	FROM users
+	INNER JOIN credentials
+	ON users.uuid = credentials.uuid
+	WHERE credentials.fingerprint = $1
+	AND credentials.revoked = false
+	AND (credentials.expires_at IS NULL OR credentials.expires_at > $2)`
+
+	args := []interface{}{fp, time.Now()}
+	var user User
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&user.UUID,
+		&user.CreatedAt,
+		&user.Username,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.MFAEnabled,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
+// RevokeCredential marks a credential as no longer usable for login without
+// deleting the row, so the fingerprint can't be silently re-registered.
+func (m CredentialModel) RevokeCredential(id int64) error {
+	query := `
+	UPDATE credentials
+	SET revoked = true
+	WHERE id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, id)
+	return err
+}
+
+// CertAuthTokenTTL is how long a ScopeCertAuth token minted by
+// ExchangeCertForToken / ExchangeSSHChallengeForToken stays valid.
+const CertAuthTokenTTL = time.Hour
+
+// ExchangeCertForToken verifies an mTLS client certificate and issues a
+// ScopeCertAuth bearer token for the user it belongs to, so a bouncer/
+// agent-style client can present its certificate once and then use a
+// normal Bearer token instead of re-presenting the full chain on every
+// request.
+func (models Models) ExchangeCertForToken(cert *x509.Certificate) (*Token, error) {
+	user, err := models.Credentials.GetUserByKeyFingerprint(certFingerprint(cert))
+	if err != nil {
+		return nil, err
+	}
+	return models.Tokens.New(user.UUID, CertAuthTokenTTL, ScopeCertAuth)
+}
+
+// ExchangeSSHChallengeForToken redeems a signed SSH challenge (see
+// CredentialModel.GenerateSSHChallenge/VerifySSHChallenge) and issues a
+// ScopeCertAuth bearer token for the owning user, letting an SSH-agent
+// client log in once per session rather than signing a fresh challenge on
+// every request.
+func (models Models) ExchangeSSHChallengeForToken(fingerprint, signatureBlob string) (*Token, error) {
+	uuid, err := models.Credentials.VerifySSHChallenge(fingerprint, signatureBlob)
+	if err != nil {
+		return nil, err
+	}
+	return models.Tokens.New(uuid, CertAuthTokenTTL, ScopeCertAuth)
+}
+
+func parseClientCertPEM(certPEM []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, errors.New("data: no PEM block found in client certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
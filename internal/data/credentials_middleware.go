@@ -0,0 +1,102 @@
+package data
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+type contextKey string
+
+const userContextKey = contextKey("user")
+
+// ContextSetUser stores the authenticated user on the request context.
+func ContextSetUser(r *http.Request, user *User) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userContextKey, user))
+}
+
+// ContextGetUser retrieves the user stashed by ContextSetUser, panicking if
+// none is present, same as the rest of the request pipeline assumes once
+// past Authenticate.
+func ContextGetUser(r *http.Request) *User {
+	user, ok := r.Context().Value(userContextKey).(*User)
+	if !ok {
+		panic("missing user value in request context")
+	}
+	return user
+}
+
+// Authenticate accepts a Bearer token, an SSH-agent challenge response, or
+// an mTLS client certificate chain, and resolves the caller to a User
+// before handing off to next. The mTLS certificate is tried first; if it
+// doesn't resolve to a user, the Authorization header is tried as either a
+// Bearer token or an SSHSig challenge response. The first form that
+// resolves sets the user and ends the lookup, so a request can't satisfy
+// the middleware twice with mismatched identities.
+func Authenticate(models Models, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Authorization")
+
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			fp := certFingerprint(r.TLS.PeerCertificates[0])
+			user, err := models.Credentials.GetUserByKeyFingerprint(fp)
+			if err == nil {
+				next.ServeHTTP(w, ContextSetUser(r, user))
+				return
+			}
+		}
+
+		authorizationHeader := r.Header.Get("Authorization")
+		if authorizationHeader != "" {
+			headerParts := strings.Split(authorizationHeader, " ")
+
+			switch {
+			case len(headerParts) == 2 && headerParts[0] == "Bearer":
+				// A Bearer token can be any of three things, tried in turn:
+				// the legacy single-token ScopeAuthentication minted by
+				// ExchangeMFAChallenge, a chunk0-4 ScopeAccess token (DB-backed
+				// from TokenModel.NewSession/Rotate, or a stateless JWT from
+				// JWTTokenModel.New - GetForToken tells those apart itself via
+				// isJWT), or a ScopeCertAuth token: the Bearer-token equivalent
+				// of the cert/key logins above, where a bouncer/agent-style
+				// client exchanges its mTLS cert or a signed SSH challenge once
+				// (see ExchangeCertForToken / ExchangeSSHChallengeForToken) and
+				// then presents the resulting token like any other Bearer
+				// token, instead of re-proving possession of the key on every
+				// call.
+				user, err := models.Users.GetForToken(ScopeAuthentication, headerParts[1])
+				if err != nil {
+					user, err = models.Users.GetForToken(ScopeAccess, headerParts[1])
+				}
+				if err != nil {
+					user, err = models.Users.GetForToken(ScopeCertAuth, headerParts[1])
+				}
+				if err == nil {
+					next.ServeHTTP(w, ContextSetUser(r, user))
+					return
+				}
+
+			case len(headerParts) == 2 && headerParts[0] == "SSHSig":
+				// headerParts[1] is "<fingerprint>:<base64 signature over the
+				// nonce issued by CredentialModel.GenerateSSHChallenge>". The
+				// fingerprint alone proves nothing - it's not secret - so
+				// identity only resolves once VerifySSHChallenge confirms the
+				// signature against the registered public key.
+				// The fingerprint itself contains a colon ("SHA256:<base64>"),
+				// so split at the last one; base64 never contains ':'.
+				if i := strings.LastIndex(headerParts[1], ":"); i > 0 {
+					uuid, err := models.Credentials.VerifySSHChallenge(headerParts[1][:i], headerParts[1][i+1:])
+					if err == nil {
+						user, err := models.Users.GetByUUID(uuid)
+						if err == nil {
+							next.ServeHTTP(w, ContextSetUser(r, user))
+							return
+						}
+					}
+				}
+			}
+		}
+
+		next.ServeHTTP(w, ContextSetUser(r, AnonymousUser))
+	})
+}
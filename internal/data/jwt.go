@@ -0,0 +1,293 @@
+package data
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TokenIssuer is implemented by every backend that can mint a Token for a
+// user: the DB-backed TokenModel (hash lookup, revocable per-row) and
+// JWTTokenModel (signature + claim check, no per-token DB row). Handlers
+// should depend on this interface rather than a concrete model so the
+// active backend can be swapped per scope.
+type TokenIssuer interface {
+	New(uuid string, ttl time.Duration, scope string) (*Token, error)
+}
+
+// isJWT reports whether tokenPlaintext looks like a compact JWS ("header.
+// claims.signature", three dot-separated segments) rather than one of the
+// opaque base32 strings generateToken produces for DB-backed tokens. Scope
+// alone can't tell the two apart: chunk0-4's NewSession/Rotate mint
+// ScopeAccess tokens as opaque DB-backed strings, so whether a given
+// ScopeAccess *token* is a JWT depends on which issuer minted it, not on
+// its scope name. Opaque tokens are base32 (RFC 4648, no padding), whose
+// alphabet excludes ".", so this is an unambiguous discriminator.
+func isJWT(tokenPlaintext string) bool {
+	return strings.Count(tokenPlaintext, ".") == 2
+}
+
+// JWTAlgorithm selects the signing algorithm for a JWTKey.
+type JWTAlgorithm string
+
+const (
+	AlgHS256 JWTAlgorithm = "HS256"
+	AlgRS256 JWTAlgorithm = "RS256"
+	AlgEdDSA JWTAlgorithm = "EdDSA"
+)
+
+// JWTKey is one entry of a JWKS-style keyset loaded at startup. Exactly one
+// of secret/private+public should be set, matching Algorithm.
+type JWTKey struct {
+	KID        string
+	Algorithm  JWTAlgorithm
+	Secret     []byte        // HS256
+	PrivateKey crypto.Signer // RS256 (*rsa.PrivateKey) / EdDSA (ed25519.PrivateKey)
+	PublicKey  crypto.PublicKey
+}
+
+// JWTTokenModel issues and verifies stateless access tokens. Unlike
+// TokenModel it stores nothing per-token; revocation works by bumping
+// User.Version (see UserModel.BumpVersion), which every verify checks against
+// the token's `ver` claim.
+type JWTTokenModel struct {
+	DB *sql.DB
+
+	// Keys is the active keyset, indexed by kid, supporting rotation:
+	// new tokens are always signed with Keys[ActiveKID], but tokens signed
+	// with any key still present in the map continue to verify.
+	Keys      map[string]JWTKey
+	ActiveKID string
+}
+
+type jwtClaims struct {
+	UUID  string `json:"uuid"`
+	Scope string `json:"scope"`
+	Exp   int64  `json:"exp"`
+	JTI   string `json:"jti"`
+	Ver   int    `json:"ver"`
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// New mints a JWT carrying {uuid, scope, exp, jti, ver}, signed with the
+// active key. The plaintext returned in Token.Plaintext is the compact JWS
+// serialisation; Token.Hash is left unset since there's no DB row for it.
+func (m JWTTokenModel) New(uuid string, ttl time.Duration, scope string) (*Token, error) {
+	key, ok := m.Keys[m.ActiveKID]
+	if !ok {
+		return nil, fmt.Errorf("data: no active JWT signing key %q configured", m.ActiveKID)
+	}
+
+	version, err := m.userVersion(uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	jti, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	expiry := time.Now().Add(ttl)
+	claims := jwtClaims{UUID: uuid, Scope: scope, Exp: expiry.Unix(), JTI: jti, Ver: version}
+
+	headerJSON, err := json.Marshal(jwtHeader{Alg: string(key.Algorithm), Kid: key.KID, Typ: "JWT"})
+	if err != nil {
+		return nil, err
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	signingInput := b64(headerJSON) + "." + b64(claimsJSON)
+	signature, err := signJWT(key, signingInput)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Token{
+		Plaintext: signingInput + "." + b64(signature),
+		UUID:      uuid,
+		Expiry:    expiry,
+		Scope:     scope,
+	}, nil
+}
+
+func (m JWTTokenModel) userVersion(uuid string) (int, error) {
+	var version int
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, `SELECT version FROM users WHERE uuid = $1`, uuid).Scan(&version)
+	return version, err
+}
+
+// Verify checks a compact JWS against the keyset and returns its claims if
+// the signature, expiry, and scope all check out. It does not check
+// user.Version - that's left to the caller (UserModel.GetForToken), which
+// has the up-to-date row already in hand.
+func (m JWTTokenModel) Verify(tokenPlaintext, wantScope string) (*jwtClaims, error) {
+	parts := strings.Split(tokenPlaintext, ".")
+	if len(parts) != 3 {
+		return nil, ErrRecordNotFound
+	}
+	signingInput := parts[0] + "." + parts[1]
+
+	var header jwtHeader
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrRecordNotFound
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, ErrRecordNotFound
+	}
+
+	key, ok := m.Keys[header.Kid]
+	if !ok || string(key.Algorithm) != header.Alg {
+		return nil, ErrRecordNotFound
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrRecordNotFound
+	}
+	if err := verifyJWT(key, signingInput, signature); err != nil {
+		return nil, ErrRecordNotFound
+	}
+
+	var claims jwtClaims
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrRecordNotFound
+	}
+	if err := json.Unmarshal(claimsJSON, &claims); err != nil {
+		return nil, ErrRecordNotFound
+	}
+
+	if claims.Scope != wantScope {
+		return nil, ErrRecordNotFound
+	}
+	if time.Now().Unix() > claims.Exp {
+		return nil, ErrRecordNotFound
+	}
+
+	return &claims, nil
+}
+
+func signJWT(key JWTKey, signingInput string) ([]byte, error) {
+	switch key.Algorithm {
+	case AlgHS256:
+		mac := hmac.New(sha256.New, key.Secret)
+		mac.Write([]byte(signingInput))
+		return mac.Sum(nil), nil
+
+	case AlgRS256:
+		digest := sha256.Sum256([]byte(signingInput))
+		return key.PrivateKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+
+	case AlgEdDSA:
+		priv, ok := key.PrivateKey.(ed25519.PrivateKey)
+		if !ok {
+			return nil, errors.New("data: EdDSA key is not an ed25519.PrivateKey")
+		}
+		return ed25519.Sign(priv, []byte(signingInput)), nil
+
+	default:
+		return nil, fmt.Errorf("data: unsupported JWT algorithm %q", key.Algorithm)
+	}
+}
+
+func verifyJWT(key JWTKey, signingInput string, signature []byte) error {
+	switch key.Algorithm {
+	case AlgHS256:
+		mac := hmac.New(sha256.New, key.Secret)
+		mac.Write([]byte(signingInput))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errors.New("data: bad HS256 signature")
+		}
+		return nil
+
+	case AlgRS256:
+		pub, ok := key.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("data: RS256 key is not an *rsa.PublicKey")
+		}
+		digest := sha256.Sum256([]byte(signingInput))
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature)
+
+	case AlgEdDSA:
+		pub, ok := key.PublicKey.(ed25519.PublicKey)
+		if !ok {
+			return errors.New("data: EdDSA key is not an ed25519.PublicKey")
+		}
+		if !ed25519.Verify(pub, []byte(signingInput), signature) {
+			return errors.New("data: bad EdDSA signature")
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("data: unsupported JWT algorithm %q", key.Algorithm)
+	}
+}
+
+// ParseJWKSKeyset loads a JWKS-style keyset from a simplified startup
+// config (one entry per key, PEM-encoded where applicable) into the map
+// JWTTokenModel.Keys expects. PrivatePEM is PEM-decoded first if it looks
+// like a PEM block, then parsed as PKCS8 DER; callers who already have raw
+// DER bytes (no PEM envelope) can pass those directly. It's intentionally
+// not a full JWKS (RFC 7517) parser - just enough structure to rotate keys
+// without a code change.
+func ParseJWKSKeyset(entries []struct {
+	KID        string
+	Algorithm  JWTAlgorithm
+	Secret     []byte
+	PrivatePEM []byte
+}) (map[string]JWTKey, error) {
+	keys := make(map[string]JWTKey, len(entries))
+	for _, e := range entries {
+		key := JWTKey{KID: e.KID, Algorithm: e.Algorithm, Secret: e.Secret}
+
+		if len(e.PrivatePEM) > 0 {
+			der := e.PrivatePEM
+			if block, _ := pem.Decode(der); block != nil {
+				der = block.Bytes
+			}
+
+			priv, err := x509.ParsePKCS8PrivateKey(der)
+			if err != nil {
+				return nil, fmt.Errorf("data: parsing private key for kid %q: %w", e.KID, err)
+			}
+			signer, ok := priv.(crypto.Signer)
+			if !ok {
+				return nil, fmt.Errorf("data: private key for kid %q is not a crypto.Signer", e.KID)
+			}
+			key.PrivateKey = signer
+			key.PublicKey = signer.Public()
+		}
+
+		keys[e.KID] = key
+	}
+	return keys, nil
+}
@@ -0,0 +1,167 @@
+package data
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJWTRoundTrip(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating RSA key: %v", err)
+	}
+	edPub, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generating Ed25519 key: %v", err)
+	}
+
+	keys := map[string]JWTKey{
+		"hs1": {KID: "hs1", Algorithm: AlgHS256, Secret: []byte("super-secret")},
+		"rs1": {KID: "rs1", Algorithm: AlgRS256, PrivateKey: rsaKey, PublicKey: &rsaKey.PublicKey},
+		"ed1": {KID: "ed1", Algorithm: AlgEdDSA, PrivateKey: edPriv, PublicKey: edPub},
+	}
+
+	for kid, key := range keys {
+		t.Run(string(key.Algorithm), func(t *testing.T) {
+			model := JWTTokenModel{Keys: keys, ActiveKID: kid}
+
+			token := signTestToken(t, model, "user-uuid", "a-scope", 1, time.Hour)
+
+			claims, err := model.Verify(token, "a-scope")
+			if err != nil {
+				t.Fatalf("Verify() returned error: %v", err)
+			}
+			if claims.UUID != "user-uuid" || claims.Ver != 1 {
+				t.Fatalf("Verify() claims = %+v, want uuid=user-uuid ver=1", claims)
+			}
+		})
+	}
+}
+
+func TestJWTVerifyRejectsWrongScope(t *testing.T) {
+	keys := map[string]JWTKey{"hs1": {KID: "hs1", Algorithm: AlgHS256, Secret: []byte("secret")}}
+	model := JWTTokenModel{Keys: keys, ActiveKID: "hs1"}
+
+	token := signTestToken(t, model, "user-uuid", "access", 1, time.Hour)
+	if _, err := model.Verify(token, "refresh"); err == nil {
+		t.Fatal("Verify() accepted a token for the wrong scope")
+	}
+}
+
+func TestJWTVerifyRejectsExpired(t *testing.T) {
+	keys := map[string]JWTKey{"hs1": {KID: "hs1", Algorithm: AlgHS256, Secret: []byte("secret")}}
+	model := JWTTokenModel{Keys: keys, ActiveKID: "hs1"}
+
+	token := signTestToken(t, model, "user-uuid", "access", 1, -time.Minute)
+	if _, err := model.Verify(token, "access"); err == nil {
+		t.Fatal("Verify() accepted an expired token")
+	}
+}
+
+func TestJWTVerifyRejectsTamperedSignature(t *testing.T) {
+	keys := map[string]JWTKey{"hs1": {KID: "hs1", Algorithm: AlgHS256, Secret: []byte("secret")}}
+	model := JWTTokenModel{Keys: keys, ActiveKID: "hs1"}
+
+	token := signTestToken(t, model, "user-uuid", "access", 1, time.Hour)
+	// Flip a bit in the signature segment rather than swapping in a fixed
+	// trailing rune: base64.RawURLEncoding's final character has unused
+	// low-order bits, so a literal "last char -> x" substitution sometimes
+	// decodes to the exact same signature bytes and the test flakes.
+	parts := strings.Split(token, ".")
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatalf("decoding signature: %v", err)
+	}
+	sig[0] ^= 0xff
+	tampered := parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString(sig)
+	if _, err := model.Verify(tampered, "access"); err == nil {
+		t.Fatal("Verify() accepted a tampered signature")
+	}
+}
+
+func TestIsJWT(t *testing.T) {
+	cases := map[string]bool{
+		"header.claims.signature": true,
+		"MFRGG2DFNZXGCY3E":        false, // base32 opaque token, no dots
+		"":                        false,
+		"one.two":                 false,
+	}
+	for token, want := range cases {
+		if got := isJWT(token); got != want {
+			t.Errorf("isJWT(%q) = %v, want %v", token, got, want)
+		}
+	}
+}
+
+func TestParseJWKSKeyset(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating RSA key: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(rsaKey)
+	if err != nil {
+		t.Fatalf("marshalling PKCS8 key: %v", err)
+	}
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	entries := []struct {
+		KID        string
+		Algorithm  JWTAlgorithm
+		Secret     []byte
+		PrivatePEM []byte
+	}{
+		{KID: "pem1", Algorithm: AlgRS256, PrivatePEM: pemBytes},
+		{KID: "der1", Algorithm: AlgRS256, PrivatePEM: der},
+		{KID: "hs1", Algorithm: AlgHS256, Secret: []byte("secret")},
+	}
+
+	keys, err := ParseJWKSKeyset(entries)
+	if err != nil {
+		t.Fatalf("ParseJWKSKeyset() returned error: %v", err)
+	}
+
+	for _, kid := range []string{"pem1", "der1"} {
+		key, ok := keys[kid]
+		if !ok || key.PrivateKey == nil || key.PublicKey == nil {
+			t.Fatalf("ParseJWKSKeyset() key %q = %+v, want a parsed private/public key pair", kid, key)
+		}
+	}
+
+	if keys["hs1"].Secret == nil {
+		t.Fatal("ParseJWKSKeyset() dropped the HS256 secret")
+	}
+}
+
+// signTestToken builds a compact JWS the same way JWTTokenModel.New does,
+// without needing the DB lookup New uses to read the caller's Version.
+func signTestToken(t *testing.T, model JWTTokenModel, uuid, scope string, version int, ttl time.Duration) string {
+	t.Helper()
+
+	key := model.Keys[model.ActiveKID]
+	claims := jwtClaims{UUID: uuid, Scope: scope, Exp: time.Now().Add(ttl).Unix(), JTI: "test-jti", Ver: version}
+
+	headerJSON, err := json.Marshal(jwtHeader{Alg: string(key.Algorithm), Kid: key.KID, Typ: "JWT"})
+	if err != nil {
+		t.Fatalf("marshalling header: %v", err)
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("marshalling claims: %v", err)
+	}
+
+	signingInput := b64(headerJSON) + "." + b64(claimsJSON)
+	signature, err := signJWT(key, signingInput)
+	if err != nil {
+		t.Fatalf("signing token: %v", err)
+	}
+
+	return signingInput + "." + b64(signature)
+}
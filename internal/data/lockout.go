@@ -0,0 +1,201 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math"
+	"time"
+
+	"backend.chesswahili.com/internal/validator"
+)
+
+// Lockout thresholds, exposed as package vars so ops can tune them without
+// a code change, same convention as Argon2Params.
+var (
+	LockoutThreshold = 5 // failures within LockoutWindow that trigger a lock
+	LockoutWindow    = 15 * time.Minute
+	LockoutBaseDelay = 30 * time.Minute // lock duration on the first lockout
+)
+
+var ErrAccountLocked = errors.New("account locked")
+
+type LoginAttemptModel struct {
+	DB *sql.DB
+}
+
+// RecordFailure logs a failed login attempt for the (uuid, ip, username)
+// tuple and, if the user has now accumulated LockoutThreshold failures
+// within LockoutWindow, locks the account. Repeated lockouts back off
+// exponentially (LockoutBaseDelay * 2^(lockCount-1)) so a sustained
+// attacker faces ever-longer waits instead of a fixed 30 minutes forever.
+func (m LoginAttemptModel) RecordFailure(uuid, ip, username string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if _, err := m.DB.ExecContext(ctx, `
+	INSERT INTO login_attempts (uuid, ip, username, success)
+	VALUES ($1, $2, $3, false)`, nullableString(uuid), ip, username); err != nil {
+		return err
+	}
+
+	if uuid == "" {
+		return nil
+	}
+
+	var failures int
+	err := m.DB.QueryRowContext(ctx, `
+	SELECT count(*) FROM login_attempts
+	WHERE uuid = $1 AND success = false AND created_at > $2`,
+		uuid, time.Now().Add(-LockoutWindow)).Scan(&failures)
+	if err != nil {
+		return err
+	}
+
+	if failures < LockoutThreshold {
+		return nil
+	}
+
+	var lockCount int
+	err = m.DB.QueryRowContext(ctx, `
+	INSERT INTO account_lockouts (uuid, locked_until, lock_count)
+	VALUES ($1, $2, 1)
+	ON CONFLICT (uuid) DO UPDATE
+	SET lock_count = account_lockouts.lock_count + 1,
+	    locked_until = $2
+	RETURNING lock_count`, uuid, time.Now()).Scan(&lockCount)
+	if err != nil {
+		return err
+	}
+
+	backoff := time.Duration(math.Pow(2, float64(lockCount-1))) * LockoutBaseDelay
+	_, err = m.DB.ExecContext(ctx, `
+	UPDATE account_lockouts SET locked_until = $1 WHERE uuid = $2`,
+		time.Now().Add(backoff), uuid)
+	return err
+}
+
+// RecordSuccess logs a successful login and clears any failure history, so
+// a legitimate login resets the threshold window.
+func (m LoginAttemptModel) RecordSuccess(uuid, ip, username string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if _, err := m.DB.ExecContext(ctx, `
+	INSERT INTO login_attempts (uuid, ip, username, success)
+	VALUES ($1, $2, $3, true)`, nullableString(uuid), ip, username); err != nil {
+		return err
+	}
+
+	_, err := m.DB.ExecContext(ctx, `
+	DELETE FROM login_attempts WHERE uuid = $1 AND success = false`, uuid)
+	return err
+}
+
+// IsLocked reports whether uuid is currently locked out.
+func (m LoginAttemptModel) IsLocked(uuid string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var lockedUntil time.Time
+	err := m.DB.QueryRowContext(ctx, `
+	SELECT locked_until FROM account_lockouts WHERE uuid = $1`, uuid).Scan(&lockedUntil)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	return time.Now().Before(lockedUntil), nil
+}
+
+// UnlockUser clears an account lockout immediately, for admin use.
+func (m LoginAttemptModel) UnlockUser(uuid string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM account_lockouts WHERE uuid = $1`, uuid)
+	return err
+}
+
+// RecordAudit appends a structured entry to auth_audit_log, for security
+// review of the login path independent of the pass/fail counters above.
+func (m LoginAttemptModel) RecordAudit(event, uuid, ip, userAgent string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, `
+	INSERT INTO auth_audit_log (event, uuid, ip, user_agent)
+	VALUES ($1, $2, $3, $4)`, event, nullableString(uuid), ip, userAgent)
+	return err
+}
+
+// LoginResult is the outcome of AuthenticateByEmailOrUsername. Exactly one
+// of User or MFAChallenge is set: a password-only account gets User back
+// immediately, while an MFA-enrolled account gets a ScopeMFAChallenge token
+// that must be redeemed via Models.ExchangeMFAChallenge with a TOTP code
+// before the login is actually complete.
+type LoginResult struct {
+	User         *User
+	MFAChallenge *Token
+}
+
+// AuthenticateByEmailOrUsername looks the user up, checks for an existing
+// lockout, and only then verifies the password - so a locked-out account
+// never reaches bcrypt/Argon2id at all, closing off both brute-force and
+// the hash-timing side channel bcrypt is prone to under load. A correct
+// password is not by itself a completed login for an MFA-enrolled account:
+// per chunk0-3, 2FA is a required step, so such accounts get back a
+// ScopeMFAChallenge token instead of a User, and the caller must finish the
+// login with Models.ExchangeMFAChallenge.
+func (models Models) AuthenticateByEmailOrUsername(identifier, plaintext, ip, userAgent string) (*LoginResult, error) {
+	var user *User
+	var err error
+	if validator.Matches(identifier, validator.EmailRX) {
+		user, err = models.Users.GetByEmail(identifier)
+	} else {
+		user, err = models.Users.GetByUsername(identifier)
+	}
+	if err != nil {
+		models.LoginAttempts.RecordAudit("login_failure_unknown_user", "", ip, userAgent)
+		return nil, err
+	}
+
+	locked, err := models.LoginAttempts.IsLocked(user.UUID)
+	if err != nil {
+		return nil, err
+	}
+	if locked {
+		models.LoginAttempts.RecordAudit("login_failure_locked", user.UUID, ip, userAgent)
+		return nil, ErrAccountLocked
+	}
+
+	matches, err := models.Users.Authenticate(user, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	if !matches {
+		if err := models.LoginAttempts.RecordFailure(user.UUID, ip, identifier); err != nil {
+			return nil, err
+		}
+		models.LoginAttempts.RecordAudit("login_failure_bad_password", user.UUID, ip, userAgent)
+		return nil, ErrRecordNotFound
+	}
+
+	if err := models.LoginAttempts.RecordSuccess(user.UUID, ip, identifier); err != nil {
+		return nil, err
+	}
+
+	if user.MFAEnabled {
+		models.LoginAttempts.RecordAudit("login_password_ok_awaiting_mfa", user.UUID, ip, userAgent)
+		challenge, err := models.Tokens.New(user.UUID, MFAChallengeTTL, ScopeMFAChallenge)
+		if err != nil {
+			return nil, err
+		}
+		return &LoginResult{MFAChallenge: challenge}, nil
+	}
+
+	models.LoginAttempts.RecordAudit("login_success", user.UUID, ip, userAgent)
+	return &LoginResult{User: user}, nil
+}
@@ -0,0 +1,361 @@
+package data
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+)
+
+const (
+	totpDigits    = 6
+	totpStep      = 30 * time.Second
+	totpSkew      = 1 // steps of drift tolerated on either side
+	totpSecretLen = 20
+
+	recoveryCodeCount  = 10
+	recoveryCodeLength = 10 // base32 characters per code
+
+	// MFAChallengeTTL is how long a ScopeMFAChallenge token stays valid
+	// while the caller completes the second factor.
+	MFAChallengeTTL = 5 * time.Minute
+)
+
+var (
+	ErrMFANotEnrolled    = errors.New("mfa not enrolled")
+	ErrMFAAlreadyEnabled = errors.New("mfa already enabled")
+	ErrInvalidTOTPCode   = errors.New("invalid totp code")
+	ErrTOTPCodeReused    = errors.New("totp code already used")
+)
+
+// MFA holds a user's TOTP enrollment: the shared secret, whether it has
+// been confirmed (mfa_enabled on users mirrors this), and the last step
+// a code was accepted for, to stop the same code being replayed within its
+// validity window.
+type MFA struct {
+	UUID         string
+	Secret       []byte // raw, not base32-encoded
+	Enabled      bool
+	LastUsedStep int64
+	CreatedAt    time.Time
+}
+
+type MFAModel struct {
+	DB *sql.DB
+}
+
+// EnrollTOTP generates a new TOTP secret for uuid and stores it unconfirmed
+// (mfa_enabled stays false until ConfirmTOTP succeeds), returning the
+// base32-encoded secret, an otpauth:// URL, and a QR code PNG encoding that URL for
+// scanning into an authenticator app.
+func (m MFAModel) EnrollTOTP(uuid, accountName string) (secret string, otpauthURL string, qrPNG []byte, err error) {
+	raw := make([]byte, totpSecretLen)
+	if _, err = rand.Read(raw); err != nil {
+		return "", "", nil, err
+	}
+
+	query := `
+	INSERT INTO mfa (uuid, secret, enabled, last_used_step)
+	VALUES ($1, $2, false, 0)
+	ON CONFLICT (uuid) DO UPDATE SET secret = EXCLUDED.secret, enabled = false, last_used_step = 0`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if _, err = m.DB.ExecContext(ctx, query, uuid, raw); err != nil {
+		return "", "", nil, err
+	}
+
+	secret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(raw)
+	otpauthURL = buildOtpauthURL("ChessSwahili", accountName, secret)
+
+	qrPNG, err = qrcode.Encode(otpauthURL, qrcode.Medium, 256)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	return secret, otpauthURL, qrPNG, nil
+}
+
+func buildOtpauthURL(issuer, accountName, secret string) string {
+	label := url.PathEscape(fmt.Sprintf("%s:%s", issuer, accountName))
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprintf("%d", totpDigits))
+	query.Set("period", fmt.Sprintf("%d", int(totpStep.Seconds())))
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, query.Encode())
+}
+
+// ConfirmTOTP verifies code against the pending enrollment for uuid and, if
+// it matches, flips mfa_enabled on. It must be called once before
+// VerifyTOTP will accept codes for this user.
+func (m MFAModel) ConfirmTOTP(uuid, code string) error {
+	mfa, err := m.get(uuid)
+	if err != nil {
+		return err
+	}
+	if mfa.Enabled {
+		return ErrMFAAlreadyEnabled
+	}
+
+	step, ok := validateTOTP(mfa.Secret, code, mfa.LastUsedStep)
+	if !ok {
+		return ErrInvalidTOTPCode
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `UPDATE mfa SET enabled = true, last_used_step = $1 WHERE uuid = $2`, step, uuid); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE users SET mfa_enabled = true WHERE uuid = $1`, uuid); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+const (
+	mfaMaxAttempts   = 5
+	mfaAttemptWindow = time.Minute
+)
+
+// mfaAttempts tracks recent failed verification attempts per UUID so a
+// stolen or guessed code can't be brute-forced against VerifyTOTP. This is
+// intentionally process-local and separate from the account-wide login
+// lockout, since a TOTP code space (10^6) needs much tighter throttling
+// than a password.
+var mfaAttempts = struct {
+	mu     sync.Mutex
+	byUUID map[string][]time.Time
+}{byUUID: make(map[string][]time.Time)}
+
+var ErrMFARateLimited = errors.New("too many mfa attempts")
+
+func mfaRateLimited(uuid string) bool {
+	mfaAttempts.mu.Lock()
+	defer mfaAttempts.mu.Unlock()
+
+	cutoff := time.Now().Add(-mfaAttemptWindow)
+	kept := mfaAttempts.byUUID[uuid][:0]
+	for _, t := range mfaAttempts.byUUID[uuid] {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	mfaAttempts.byUUID[uuid] = kept
+
+	return len(kept) >= mfaMaxAttempts
+}
+
+func recordMFAAttempt(uuid string) {
+	mfaAttempts.mu.Lock()
+	defer mfaAttempts.mu.Unlock()
+	mfaAttempts.byUUID[uuid] = append(mfaAttempts.byUUID[uuid], time.Now())
+}
+
+// VerifyTOTP checks code for an already-enabled enrollment, rejecting a
+// step number that has already been consumed so a captured code can't be
+// replayed within its ±1 step window. Verification attempts are
+// rate-limited per UUID to blunt brute-forcing the 6-digit code space.
+func (m MFAModel) VerifyTOTP(uuid, code string) error {
+	if mfaRateLimited(uuid) {
+		return ErrMFARateLimited
+	}
+
+	mfa, err := m.get(uuid)
+	if err != nil {
+		return err
+	}
+	if !mfa.Enabled {
+		return ErrMFANotEnrolled
+	}
+
+	step, ok := validateTOTP(mfa.Secret, code, mfa.LastUsedStep)
+	if !ok {
+		recordMFAAttempt(uuid)
+		return ErrInvalidTOTPCode
+	}
+
+	query := `
+	UPDATE mfa SET last_used_step = $1 WHERE uuid = $2 AND last_used_step < $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, step, uuid)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		recordMFAAttempt(uuid)
+		return ErrTOTPCodeReused
+	}
+	return nil
+}
+
+func (m MFAModel) get(uuid string) (*MFA, error) {
+	query := `
+	SELECT uuid, secret, enabled, last_used_step, created_at
+	FROM mfa
+	WHERE uuid = $1`
+	var mfa MFA
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, uuid).Scan(&mfa.UUID, &mfa.Secret, &mfa.Enabled, &mfa.LastUsedStep, &mfa.CreatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrMFANotEnrolled
+		default:
+			return nil, err
+		}
+	}
+	return &mfa, nil
+}
+
+// validateTOTP tries the current step and up to totpSkew steps on either
+// side, rejecting any step at or before lastUsedStep. It returns the step
+// number that matched so the caller can persist it.
+func validateTOTP(secret []byte, code string, lastUsedStep int64) (step int64, ok bool) {
+	now := time.Now().Unix() / int64(totpStep.Seconds())
+
+	for delta := -totpSkew; delta <= totpSkew; delta++ {
+		candidate := now + int64(delta)
+		if candidate <= lastUsedStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(generateTOTP(secret, candidate)), []byte(code)) == 1 {
+			return candidate, true
+		}
+	}
+	return 0, false
+}
+
+// generateTOTP implements RFC 6238 over HMAC-SHA1 (RFC 4226's HOTP), the
+// algorithm every mainstream authenticator app assumes by default.
+func generateTOTP(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	truncated := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	code := truncated % uint32(math.Pow10(totpDigits))
+
+	return fmt.Sprintf("%0*d", totpDigits, code)
+}
+
+// RecoveryCode is a single-use fallback for when the authenticator device
+// is unavailable. Only its SHA-256 hash is stored, same as tokens.
+type RecoveryCode struct {
+	UUID string
+	Hash []byte
+	Used bool
+}
+
+// GenerateRecoveryCodes replaces any existing recovery codes for uuid with
+// a fresh batch of recoveryCodeCount single-use base32 codes, returning the
+// plaintexts for one-time display.
+func (m MFAModel) GenerateRecoveryCodes(uuid string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM mfa_recovery_codes WHERE uuid = $1`, uuid); err != nil {
+		return nil, err
+	}
+
+	plaintexts := make([]string, recoveryCodeCount)
+	for i := range plaintexts {
+		raw := make([]byte, recoveryCodeLength)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		code := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(raw)[:recoveryCodeLength]
+		plaintexts[i] = code
+
+		hash := sha256.Sum256([]byte(code))
+		_, err := tx.ExecContext(ctx, `
+		INSERT INTO mfa_recovery_codes (uuid, hash, used)
+		VALUES ($1, $2, false)`, uuid, hash[:])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return plaintexts, nil
+}
+
+// ExchangeMFAChallenge redeems a ScopeMFAChallenge token (issued after a
+// successful password check) together with a TOTP code for a real
+// ScopeAuthentication token, making 2FA a required second step of login
+// rather than something bolted on after the fact.
+func (models Models) ExchangeMFAChallenge(challengePlaintext, totpCode string) (*Token, error) {
+	user, err := models.Users.GetForToken(ScopeMFAChallenge, challengePlaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := models.MFA.VerifyTOTP(user.UUID, totpCode); err != nil {
+		return nil, err
+	}
+
+	if err := models.Tokens.DeleteAllForUser(ScopeMFAChallenge, user.UUID); err != nil {
+		return nil, err
+	}
+
+	return models.Tokens.New(user.UUID, 24*time.Hour, ScopeAuthentication)
+}
+
+// ConsumeRecoveryCode redeems code for uuid, marking it used so it can
+// never be presented again. It returns ErrInvalidTOTPCode if the code is
+// unknown or already spent.
+func (m MFAModel) ConsumeRecoveryCode(uuid, code string) error {
+	hash := sha256.Sum256([]byte(strings.ToUpper(code)))
+
+	query := `
+	UPDATE mfa_recovery_codes
+	SET used = true
+	WHERE uuid = $1 AND hash = $2 AND used = false`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, uuid, hash[:])
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrInvalidTOTPCode
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidateTOTP(t *testing.T) {
+	secret := []byte("a-test-totp-secret-")
+	now := time.Now().Unix() / int64(totpStep.Seconds())
+
+	t.Run("accepts the current step", func(t *testing.T) {
+		code := generateTOTP(secret, now)
+		step, ok := validateTOTP(secret, code, 0)
+		if !ok || step != now {
+			t.Fatalf("validateTOTP(current) = (%d, %v), want (%d, true)", step, ok, now)
+		}
+	})
+
+	t.Run("tolerates one step of drift on either side", func(t *testing.T) {
+		for _, delta := range []int64{-1, 1} {
+			code := generateTOTP(secret, now+delta)
+			step, ok := validateTOTP(secret, code, 0)
+			if !ok || step != now+delta {
+				t.Fatalf("validateTOTP(delta=%d) = (%d, %v), want (%d, true)", delta, step, ok, now+delta)
+			}
+		}
+	})
+
+	t.Run("rejects drift beyond the tolerance window", func(t *testing.T) {
+		code := generateTOTP(secret, now+totpSkew+1)
+		if _, ok := validateTOTP(secret, code, 0); ok {
+			t.Fatal("validateTOTP accepted a code outside the skew window")
+		}
+	})
+
+	t.Run("rejects a step at or before lastUsedStep", func(t *testing.T) {
+		code := generateTOTP(secret, now)
+		if _, ok := validateTOTP(secret, code, now); ok {
+			t.Fatal("validateTOTP accepted a step already marked as used (replay)")
+		}
+	})
+
+	t.Run("rejects a wrong code", func(t *testing.T) {
+		if _, ok := validateTOTP(secret, "000000", 0); ok {
+			t.Fatal("validateTOTP accepted an incorrect code")
+		}
+	})
+}
@@ -5,15 +5,35 @@ import (
 )
 
 type Models struct {
-	Users  UserModel
-	Tokens TokenModel
-	Accounts AccountModel
+	Users         UserModel
+	Tokens        TokenModel
+	Accounts      AccountModel
+	Credentials   CredentialModel
+	MFA           MFAModel
+	LoginAttempts LoginAttemptModel
 }
 
-func NewModels(db *sql.DB) Models {
+// NewModels wires up every model against db. jwt is optional: pass nil for
+// deployments that only issue DB-backed tokens, or a *JWTTokenModel with its
+// Keys/ActiveKID configured to also accept stateless JWT access tokens (see
+// UserModel.GetForToken / isJWT). jwt is copied, with its DB field set to
+// db, rather than mutated in place - callers are free to keep one
+// keys/ActiveKID configuration and reuse it across multiple NewModels calls
+// (e.g. per test, per tenant) without them aliasing each other's DB.
+func NewModels(db *sql.DB, jwt *JWTTokenModel) Models {
+	var userJWT *JWTTokenModel
+	if jwt != nil {
+		j := *jwt
+		j.DB = db
+		userJWT = &j
+	}
+
 	return Models{
-		Tokens: TokenModel{DB: db},
-		Users:  UserModel{DB: db},
-		Accounts: AccountModel{DB: db},
+		Tokens:        TokenModel{DB: db},
+		Users:         UserModel{DB: db, JWT: userJWT},
+		Accounts:      AccountModel{DB: db},
+		Credentials:   CredentialModel{DB: db},
+		MFA:           MFAModel{DB: db},
+		LoginAttempts: LoginAttemptModel{DB: db},
 	}
 }
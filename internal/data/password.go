@@ -0,0 +1,144 @@
+package data
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Argon2Params are the cost parameters used when hashing new passwords.
+// They're exposed as package vars rather than constants so ops can tune
+// memory/time/parallelism per deployment without a code change; NewModels
+// callers that care can overwrite them at startup before serving traffic.
+var Argon2Params = struct {
+	Memory      uint32
+	Time        uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}{
+	Memory:      65536,
+	Time:        3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// PasswordHasher hashes and verifies plaintext passwords against a
+// self-describing stored hash (e.g. "$argon2id$..." or "$2a$...").
+type PasswordHasher interface {
+	Hash(plaintext string) ([]byte, error)
+	Matches(hash []byte, plaintext string) (bool, error)
+
+	// Prefix is the leading marker of hashes this implementation produces,
+	// used to dispatch an incoming hash to the right Matches implementation.
+	Prefix() string
+}
+
+type argon2idHasher struct{}
+
+func (argon2idHasher) Prefix() string { return "$argon2id$" }
+
+func (argon2idHasher) Hash(plaintext string) ([]byte, error) {
+	salt := make([]byte, Argon2Params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	key := argon2.IDKey([]byte(plaintext), salt, Argon2Params.Time, Argon2Params.Memory, Argon2Params.Parallelism, Argon2Params.KeyLength)
+
+	encoded := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		Argon2Params.Memory, Argon2Params.Time, Argon2Params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	)
+	return []byte(encoded), nil
+}
+
+func (argon2idHasher) Matches(hash []byte, plaintext string) (bool, error) {
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 {
+		return false, errors.New("data: malformed argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return false, err
+	}
+	if version != argon2.Version {
+		return false, errors.New("data: unsupported argon2id version")
+	}
+
+	var memory, time uint32
+	var parallelism uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &parallelism); err != nil {
+		return false, err
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, err
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, err
+	}
+
+	got := argon2.IDKey([]byte(plaintext), salt, time, memory, parallelism, uint32(len(want)))
+	if subtle.ConstantTimeCompare(got, want) == 1 {
+		return true, nil
+	}
+	return false, nil
+}
+
+type bcryptHasher struct{}
+
+func (bcryptHasher) Prefix() string { return "$2a$" }
+
+func (bcryptHasher) Hash(plaintext string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(plaintext), 12)
+}
+
+func (bcryptHasher) Matches(hash []byte, plaintext string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword(hash, []byte(plaintext))
+	if err != nil {
+		switch {
+		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// DefaultHasher is used for every newly-set password. Argon2id replaces
+// bcrypt as of this change; bcryptHasher is kept only so existing hashes
+// already in the database keep verifying.
+var DefaultHasher PasswordHasher = argon2idHasher{}
+
+var legacyHashers = []PasswordHasher{argon2idHasher{}, bcryptHasher{}}
+
+// hasherFor dispatches a stored hash to the implementation that produced it,
+// based on its prefix.
+func hasherFor(hash []byte) (PasswordHasher, error) {
+	for _, h := range legacyHashers {
+		if strings.HasPrefix(string(hash), h.Prefix()) {
+			return h, nil
+		}
+	}
+	return nil, fmt.Errorf("data: unrecognised password hash format")
+}
+
+// needsRehash reports whether hash was produced by anything other than
+// DefaultHasher, so a successful login can transparently upgrade it.
+func needsRehash(hash []byte) bool {
+	return !strings.HasPrefix(string(hash), DefaultHasher.Prefix())
+}
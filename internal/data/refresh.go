@@ -0,0 +1,216 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	AccessTokenTTL  = 15 * time.Minute
+	RefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+var ErrRefreshReused = errors.New("refresh token reused")
+
+// NewSession issues a fresh access/refresh pair for uuid, starting a new
+// token family. The refresh token is generation 1 of that family.
+func (m TokenModel) NewSession(uuid string) (access *Token, refresh *Token, err error) {
+	access, err = generateToken(uuid, AccessTokenTTL, ScopeAccess)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	familyUUID, err := newUUID()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	refresh, err = generateToken(uuid, RefreshTokenTTL, ScopeRefresh)
+	if err != nil {
+		return nil, nil, err
+	}
+	refresh.Family = familyUUID
+	refresh.Generation = 1
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+	INSERT INTO token_families (id, uuid, revoked, current_generation)
+	VALUES ($1, $2, false, 1)`, familyUUID, uuid); err != nil {
+		return nil, nil, err
+	}
+
+	if err := insertTokenTx(ctx, tx, access); err != nil {
+		return nil, nil, err
+	}
+	if err := insertTokenTx(ctx, tx, refresh); err != nil {
+		return nil, nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+	return access, refresh, nil
+}
+
+// Rotate atomically invalidates the refresh token behind oldRefreshPlaintext
+// and issues a new access/refresh pair in the same family. If the presented
+// refresh token has already been rotated once before (i.e. it's not the
+// current generation for its family), the whole family is revoked and
+// ErrRefreshReused is returned: presenting a superseded refresh token is
+// only possible if it was stolen, so every token descending from it is
+// treated as compromised.
+func (m TokenModel) Rotate(oldRefreshPlaintext string) (access *Token, refresh *Token, err error) {
+	oldHash := sha256.Sum256([]byte(oldRefreshPlaintext))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	var uuid, family string
+	var generation int
+	var expiry time.Time
+	err = tx.QueryRowContext(ctx, `
+	SELECT uuid, family, generation, expiry
+	FROM tokens
+	WHERE hash = $1 AND scope = $2`, oldHash[:], ScopeRefresh).Scan(&uuid, &family, &generation, &expiry)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	if time.Now().After(expiry) {
+		return nil, nil, ErrRecordNotFound
+	}
+
+	var revoked bool
+	var currentGeneration int
+	err = tx.QueryRowContext(ctx, `
+	SELECT revoked, current_generation FROM token_families WHERE id = $1 FOR UPDATE`, family).Scan(&revoked, &currentGeneration)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	if revoked || generation != currentGeneration {
+		if err := revokeFamilyTx(ctx, tx, family); err != nil {
+			return nil, nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, ErrRefreshReused
+	}
+
+	// The presented token's row is kept rather than deleted: bumping
+	// current_generation below is what invalidates it, and keeping the row
+	// is what lets a later replay of it be detected as reuse above.
+	access, err = generateToken(uuid, AccessTokenTTL, ScopeAccess)
+	if err != nil {
+		return nil, nil, err
+	}
+	refresh, err = generateToken(uuid, RefreshTokenTTL, ScopeRefresh)
+	if err != nil {
+		return nil, nil, err
+	}
+	refresh.Family = family
+	refresh.Generation = currentGeneration + 1
+
+	if _, err := tx.ExecContext(ctx, `
+	UPDATE token_families SET current_generation = $1 WHERE id = $2`, refresh.Generation, family); err != nil {
+		return nil, nil, err
+	}
+
+	if err := insertTokenTx(ctx, tx, access); err != nil {
+		return nil, nil, err
+	}
+	if err := insertTokenTx(ctx, tx, refresh); err != nil {
+		return nil, nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+	return access, refresh, nil
+}
+
+// RevokeFamily revokes every refresh token descending from familyUUID,
+// ending the session it represents regardless of which generation is
+// currently live.
+func (m TokenModel) RevokeFamily(familyUUID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := revokeFamilyTx(ctx, tx, familyUUID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func revokeFamilyTx(ctx context.Context, tx *sql.Tx, familyUUID string) error {
+	if _, err := tx.ExecContext(ctx, `UPDATE token_families SET revoked = true WHERE id = $1`, familyUUID); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, `DELETE FROM tokens WHERE family = $1`, familyUUID)
+	return err
+}
+
+func insertTokenTx(ctx context.Context, tx *sql.Tx, token *Token) error {
+	_, err := tx.ExecContext(ctx, `
+	INSERT INTO tokens (hash, uuid, expiry, scope, family, generation)
+	VALUES ($1, $2, $3, $4, $5, $6)`,
+		token.Hash, token.UUID, token.Expiry, token.Scope, nullableString(token.Family), token.Generation)
+	return err
+}
+
+func nullableString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// newUUID generates a random UUID v4 client-side, needed here (unlike
+// user UUIDs, which Postgres assigns via uuid_generate_v4()) because the
+// family id has to exist before the row that references it is inserted,
+// in the same transaction.
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
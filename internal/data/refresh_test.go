@@ -0,0 +1,89 @@
+package data
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestTokenModelRotate(t *testing.T) {
+	t.Run("rotates a current-generation refresh token", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("opening sqlmock: %v", err)
+		}
+		defer db.Close()
+
+		const family = "11111111-1111-4111-8111-111111111111"
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(regexp.QuoteMeta(`SELECT uuid, family, generation, expiry FROM tokens WHERE hash = $1 AND scope = $2`)).
+			WillReturnRows(sqlmock.NewRows([]string{"uuid", "family", "generation", "expiry"}).
+				AddRow("user-uuid", family, 1, time.Now().Add(time.Hour)))
+		mock.ExpectQuery(regexp.QuoteMeta(`SELECT revoked, current_generation FROM token_families WHERE id = $1 FOR UPDATE`)).
+			WillReturnRows(sqlmock.NewRows([]string{"revoked", "current_generation"}).AddRow(false, 1))
+		// No DELETE of the presented token is expected: its row stays so a
+		// replay can be detected, and sqlmock fails on any unexpected call.
+		mock.ExpectExec(regexp.QuoteMeta(`UPDATE token_families SET current_generation = $1 WHERE id = $2`)).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO tokens (hash, uuid, expiry, scope, family, generation)`)).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO tokens (hash, uuid, expiry, scope, family, generation)`)).
+			WillReturnResult(sqlmock.NewResult(2, 1))
+		mock.ExpectCommit()
+
+		model := TokenModel{DB: db}
+		access, refresh, err := model.Rotate("old-refresh-plaintext")
+		if err != nil {
+			t.Fatalf("Rotate() returned error: %v", err)
+		}
+		if access.Scope != ScopeAccess || refresh.Scope != ScopeRefresh {
+			t.Fatalf("Rotate() scopes = (%q, %q), want (%q, %q)", access.Scope, refresh.Scope, ScopeAccess, ScopeRefresh)
+		}
+		if refresh.Family != family || refresh.Generation != 2 {
+			t.Fatalf("Rotate() refresh = {Family: %q, Generation: %d}, want {%q, 2}", refresh.Family, refresh.Generation, family)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("unmet expectations: %v", err)
+		}
+	})
+
+	t.Run("revokes the family when a superseded refresh token is replayed", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("opening sqlmock: %v", err)
+		}
+		defer db.Close()
+
+		const family = "22222222-2222-4222-8222-222222222222"
+
+		mock.ExpectBegin()
+		// This refresh token was generation 1, but the family has already
+		// moved to generation 2 - i.e. it was already rotated once, and
+		// someone (the legitimate client or an attacker holding a stolen
+		// copy) is presenting the old one again.
+		mock.ExpectQuery(regexp.QuoteMeta(`SELECT uuid, family, generation, expiry FROM tokens WHERE hash = $1 AND scope = $2`)).
+			WillReturnRows(sqlmock.NewRows([]string{"uuid", "family", "generation", "expiry"}).
+				AddRow("user-uuid", family, 1, time.Now().Add(time.Hour)))
+		mock.ExpectQuery(regexp.QuoteMeta(`SELECT revoked, current_generation FROM token_families WHERE id = $1 FOR UPDATE`)).
+			WillReturnRows(sqlmock.NewRows([]string{"revoked", "current_generation"}).AddRow(false, 2))
+		mock.ExpectExec(regexp.QuoteMeta(`UPDATE token_families SET revoked = true WHERE id = $1`)).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM tokens WHERE family = $1`)).
+			WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectCommit()
+
+		model := TokenModel{DB: db}
+		_, _, err = model.Rotate("superseded-refresh-plaintext")
+		if err != ErrRefreshReused {
+			t.Fatalf("Rotate() error = %v, want ErrRefreshReused", err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("unmet expectations: %v", err)
+		}
+	})
+}
@@ -14,8 +14,11 @@ import (
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
-	ScopePasswordReset = "password-reset"
-
+	ScopePasswordReset  = "password-reset"
+	ScopeCertAuth       = "cert-auth"
+	ScopeMFAChallenge   = "mfa-challenge"
+	ScopeAccess         = "access"
+	ScopeRefresh        = "refresh"
 )
 
 type Token struct {
@@ -24,6 +27,12 @@ type Token struct {
 	UUID      string    `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+
+	// Family and Generation are only set for ScopeRefresh tokens, linking
+	// successive rotations of the same refresh token so reuse of a
+	// superseded one can be detected. Zero-valued for every other scope.
+	Family     string `json:"-"`
+	Generation int    `json:"-"`
 }
 
 func generateToken(UUID string, ttl time.Duration, scope string) (*Token, error) {
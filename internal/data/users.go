@@ -9,7 +9,6 @@ import (
 	"time"
 
 	"backend.chesswahili.com/internal/validator"
-	"golang.org/x/crypto/bcrypt"
 )
 
 var (
@@ -22,13 +21,14 @@ var (
 var AnonymousUser = &User{}
 
 type User struct {
-	UUID      string    `json:"uuid"`
-	Username  string    `json:"username"`
-	CreatedAt time.Time `json:"created_at"`
-	Email     string    `json:"email"`
-	Password  password  `json:"-"`
-	Activated bool      `json:"activated"`
-	Version   int       `json:"-"`
+	UUID       string    `json:"uuid"`
+	Username   string    `json:"username"`
+	CreatedAt  time.Time `json:"created_at"`
+	Email      string    `json:"email"`
+	Password   password  `json:"-"`
+	Activated  bool      `json:"activated"`
+	MFAEnabled bool      `json:"mfa_enabled"`
+	Version    int       `json:"-"`
 }
 
 type password struct {
@@ -37,7 +37,7 @@ type password struct {
 }
 
 func (p *password) Set(plaintextpassword string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextpassword), 12)
+	hash, err := DefaultHasher.Hash(plaintextpassword)
 	if err != nil {
 		return err
 	}
@@ -50,18 +50,11 @@ func (p *password) Set(plaintextpassword string) error {
 }
 
 func (p *password) Matches(plaintextpassword string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextpassword))
+	hasher, err := hasherFor(p.hash)
 	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			return false, nil
-		default:
-			return false, err
-		}
-
+		return false, err
 	}
-
-	return true, nil
+	return hasher.Matches(p.hash, plaintextpassword)
 }
 
 func ValidateEmail(v *validator.Validator, email string) {
@@ -69,13 +62,13 @@ func ValidateEmail(v *validator.Validator, email string) {
 	v.Check(validator.Matches(email, validator.EmailRX), "email", "must be a valid email address")
 }
 
-func ValidateEmailOrUsername(v *validator.Validator,  uncheckedStr string )(map[string]string) {
+func ValidateEmailOrUsername(v *validator.Validator, uncheckedStr string) map[string]string {
 	v.Check(uncheckedStr != "", "email/username", "must be provided")
 	if validator.Matches(uncheckedStr, validator.EmailRX) {
-		return map[string]string{"email" : uncheckedStr}
+		return map[string]string{"email": uncheckedStr}
 	}
 
-	return map[string]string{"username" : uncheckedStr}
+	return map[string]string{"username": uncheckedStr}
 }
 func ValidateUsername(v *validator.Validator, username string) {
 	v.Check(username != "", "username", "must be provided")
@@ -102,6 +95,11 @@ func ValidateUser(v *validator.Validator, user *User) {
 
 type UserModel struct {
 	DB *sql.DB
+
+	// JWT is consulted by GetForToken whenever a presented token is itself
+	// a JWT (see isJWT). Left nil, JWTs simply aren't accepted, which is
+	// fine for deployments that only use DB-backed tokens.
+	JWT *JWTTokenModel
 }
 
 // uuid_generate_v4()
@@ -132,7 +130,7 @@ func (m UserModel) Insert(user *User) error {
 
 func (m UserModel) GetByEmail(email string) (*User, error) {
 	query := `
-SELECT uuid, created_at, username, email, password_hash, activated, version
+SELECT uuid, created_at, username, email, password_hash, activated, mfa_enabled, version
 FROM users
 WHERE email = $1`
 	var user User
@@ -145,6 +143,7 @@ WHERE email = $1`
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.MFAEnabled,
 		&user.Version,
 	)
 	if err != nil {
@@ -160,7 +159,7 @@ WHERE email = $1`
 
 func (m UserModel) GetByUsername(username string) (*User, error) {
 	query := `
-SELECT uuid, created_at, username, email, password_hash, activated, version
+SELECT uuid, created_at, username, email, password_hash, activated, mfa_enabled, version
 FROM users
 WHERE username = $1`
 	var user User
@@ -173,6 +172,7 @@ WHERE username = $1`
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.MFAEnabled,
 		&user.Version,
 	)
 	if err != nil {
@@ -189,14 +189,15 @@ WHERE username = $1`
 func (m UserModel) Update(user *User) error {
 	query := `
 UPDATE users
-SET username = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
-WHERE uuid = $5 AND version = $6
+SET username = $1, email = $2, password_hash = $3, activated = $4, mfa_enabled = $5, version = version + 1
+WHERE uuid = $6 AND version = $7
 RETURNING version`
 	args := []interface{}{
 		user.Username,
 		user.Email,
 		user.Password.hash,
 		user.Activated,
+		user.MFAEnabled,
 		user.UUID,
 		user.Version,
 	}
@@ -218,12 +219,23 @@ RETURNING version`
 	return nil
 }
 
+// GetForToken resolves a token to the user it belongs to. If tokenPlaintext
+// is itself a JWT (see isJWT) it's verified via m.JWT and its ver claim is
+// checked against the user's current Version, instead of touching the
+// tokens table at all; this is independent of tokenScope, since the same
+// scope (e.g. ScopeAccess) can be minted either as a JWT by JWTTokenModel
+// or as an opaque DB-backed token by TokenModel.NewSession/Rotate,
+// depending on which issuer a given deployment wires up. Anything that
+// isn't a JWT keeps the original hash-lookup path.
 func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
+	if isJWT(tokenPlaintext) {
+		return m.getForJWT(tokenScope, tokenPlaintext)
+	}
 
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
 	// Set up the SQL query.
 	query := `
-	SELECT users.uuid, users.created_at, users.username, users.email, users.password_hash, users.activated, users.version
+	SELECT users.uuid, users.created_at, users.username, users.email, users.password_hash, users.activated, users.mfa_enabled, users.version
 	FROM users
 	INNER JOIN tokens
 	ON users.uuid = tokens.uuid
@@ -243,6 +255,7 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.MFAEnabled,
 		&user.Version,
 	)
 	if err != nil {
@@ -257,6 +270,91 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 	return &user, nil
 }
 
+func (m UserModel) getForJWT(tokenScope, tokenPlaintext string) (*User, error) {
+	if m.JWT == nil {
+		return nil, ErrRecordNotFound
+	}
+
+	claims, err := m.JWT.Verify(tokenPlaintext, tokenScope)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := m.GetByUUID(claims.UUID)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Version != claims.Ver {
+		return nil, ErrRecordNotFound
+	}
+	return user, nil
+}
+
+func (m UserModel) GetByUUID(uuid string) (*User, error) {
+	query := `
+	SELECT uuid, created_at, username, email, password_hash, activated, mfa_enabled, version
+	FROM users
+	WHERE uuid = $1`
+	var user User
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, uuid).Scan(
+		&user.UUID,
+		&user.CreatedAt,
+		&user.Username,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.MFAEnabled,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
+// BumpVersion increments the user's Version, the stateless equivalent of
+// TokenModel.DeleteAllForUser: every JWT issued before the bump carries the
+// old ver claim and is rejected by getForJWT on its next use, without
+// needing a per-token revocation list.
+func (m UserModel) BumpVersion(uuid string) error {
+	query := `UPDATE users SET version = version + 1 WHERE uuid = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, uuid)
+	return err
+}
+
+// Authenticate checks plaintext against the user's stored password hash
+// and, if it matches but the hash wasn't produced by DefaultHasher (e.g. a
+// legacy bcrypt hash), transparently re-hashes and persists the password
+// with DefaultHasher so the migration to Argon2id happens without forcing
+// a reset.
+func (m UserModel) Authenticate(user *User, plaintext string) (bool, error) {
+	matches, err := user.Password.Matches(plaintext)
+	if err != nil || !matches {
+		return matches, err
+	}
+
+	if needsRehash(user.Password.hash) {
+		if err := user.Password.Set(plaintext); err != nil {
+			return true, err
+		}
+		if err := m.Update(user); err != nil {
+			return true, err
+		}
+	}
+
+	return true, nil
+}
+
 func (u *User) IsAnonymous() bool {
 	return u == AnonymousUser
 }